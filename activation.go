@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+import (
+	"agent/misc/systemd"
+	"agent/utils"
+)
+
+// sockets inherited from systemd socket activation,
+// preferred over binding the listening address.
+var (
+	activatedTCP *net.TCPListener
+	activatedUDP net.PacketConn
+)
+
+func initActivation() {
+	for _, f := range systemd.Files() {
+		if l, err := net.FileListener(f); err == nil {
+			if tl, ok := l.(*net.TCPListener); ok && activatedTCP == nil {
+				activatedTCP = tl
+				log.Info("tcp socket activated:", tl.Addr())
+			} else {
+				l.Close()
+			}
+		} else if c, err := net.FilePacketConn(f); err == nil {
+			if activatedUDP == nil {
+				activatedUDP = c
+				log.Info("udp socket activated:", c.LocalAddr())
+			} else {
+				c.Close()
+			}
+		} else {
+			log.Warning("unsupported activated socket:", f.Name())
+		}
+		f.Close()
+	}
+}
+
+// report readiness & keep the systemd watchdog happy
+func notifyReady() {
+	if err := systemd.Notify(systemd.READY); err != nil {
+		log.Warning("sd_notify failed:", err)
+	}
+
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go func() {
+			defer utils.PrintPanicStack()
+			for {
+				<-time.After(interval)
+				systemd.Notify(systemd.WATCHDOG)
+			}
+		}()
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"net"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -13,6 +15,30 @@ import (
 	"agent/utils"
 )
 
+var (
+	ERROR_WRITE_DEADLINE = errors.New("write-deadline must be positive")
+	ERROR_PENDING_LIMIT  = errors.New("pending-limit must be positive")
+)
+
+var (
+	writeDeadline time.Duration
+	pendingLimit  int
+)
+
+// a zero deadline would fail every write, and a zero queue
+// would kick every client with a write in flight.
+func initBuffer(write_deadline time.Duration, pending_limit int) error {
+	if write_deadline <= 0 {
+		return ERROR_WRITE_DEADLINE
+	}
+	if pending_limit <= 0 {
+		return ERROR_PENDING_LIMIT
+	}
+	writeDeadline = write_deadline
+	pendingLimit = pending_limit
+	return nil
+}
+
 // PIPELINE #3: buffer
 // controls the packet sending for the client
 type Buffer struct {
@@ -39,7 +65,18 @@ func (buf *Buffer) send(sess *Session, data []byte) {
 	}
 
 	// queue the data for sending
-	buf.pending <- data
+	// a client which cannot keep up with the outgoing packets is kicked out,
+	// rather than blocking the session.
+	select {
+	case buf.pending <- data:
+	default:
+		sess.Flag |= SESS_KICKED_OUT
+		log.WithFields(log.Fields{
+			"userid":  sess.UserId,
+			"ip":      sess.IP,
+			"pending": len(buf.pending),
+		}).Error("SENDQ FULL")
+	}
 	return
 }
 
@@ -49,7 +86,10 @@ func (buf *Buffer) start() {
 	for {
 		select {
 		case data := <-buf.pending:
-			buf.raw_send(data)
+			if !buf.raw_send(data) {
+				// wake up the reader, the session will close
+				buf.conn.Close()
+			}
 		case <-buf.ctrl: // receive session end signal
 			close(buf.pending)
 			// close the connection
@@ -61,17 +101,41 @@ func (buf *Buffer) start() {
 
 // raw packet encapsulation and put it online
 func (buf *Buffer) raw_send(data []byte) bool {
-	// combine output to reduce syscall.write
-	sz := len(data)
-	binary.BigEndian.PutUint16(buf.cache, uint16(sz))
-	copy(buf.cache[2:], data)
+	// combine output to reduce syscall.write,
+	// packets already queued are packed into the same write.
+	sz, count := 0, 0
+	for data != nil {
+		if sz+len(data)+2 > len(buf.cache) {
+			if !buf.flush(sz, count) {
+				return false
+			}
+			sz, count = 0, 0
+		}
+		binary.BigEndian.PutUint16(buf.cache[sz:], uint16(len(data)))
+		copy(buf.cache[sz+2:], data)
+		sz += len(data) + 2
+		count++
+
+		select {
+		case data = <-buf.pending:
+		default:
+			data = nil
+		}
+	}
+	return buf.flush(sz, count)
+}
 
-	// write data
-	n, err := buf.conn.Write(buf.cache[:sz+2])
+// write the packed packets in cache
+func (buf *Buffer) flush(sz, count int) bool {
+	// write data, a write deadline prevents stalling forever on dead peers
+	buf.conn.SetWriteDeadline(time.Now().Add(writeDeadline))
+	n, err := buf.conn.Write(buf.cache[:sz])
 	if err != nil {
 		log.Warningf("Error send reply data, bytes: %v reason: %v", n, err)
 		return false
 	}
+	metricPacketsOut.Add(int64(count))
+	metricBytesOut.Add(int64(n))
 
 	return true
 }
@@ -79,7 +143,7 @@ func (buf *Buffer) raw_send(data []byte) bool {
 // create a associated write buffer for a session
 func new_buffer(conn net.Conn, ctrl chan struct{}) *Buffer {
 	buf := Buffer{conn: conn}
-	buf.pending = make(chan []byte)
+	buf.pending = make(chan []byte, pendingLimit)
 	buf.ctrl = ctrl
 	buf.cache = make([]byte, packet.PACKET_LIMIT+2)
 	return &buf
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"agent/misc/packet"
+)
+
+// records the size of every write
+type writeRecorder struct {
+	net.Conn
+	writes []int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Conn.Write(p)
+}
+
+func TestBufferRawSend(t *testing.T) {
+	if err := initBuffer(time.Second, 16); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &writeRecorder{Conn: server}
+	buf := new_buffer(conn, make(chan struct{}))
+
+	// 30000+5000+30531 fills the cache exactly, 1 flushes it,
+	// a PACKET_LIMIT packet needs the whole cache on its own.
+	sizes := []int{30000, 5000, 30531, 1, packet.PACKET_LIMIT, 7}
+	var packets [][]byte
+	for i, sz := range sizes {
+		packets = append(packets, bytes.Repeat([]byte{byte(i + 1)}, sz))
+	}
+	for _, p := range packets[1:] {
+		buf.pending <- p
+	}
+
+	packetsOut := metricPacketsOut.Value()
+	done := make(chan bool, 1)
+	go func() {
+		done <- buf.raw_send(packets[0])
+		server.Close()
+	}()
+
+	header := make([]byte, 2)
+	for i, p := range packets {
+		if _, err := io.ReadFull(client, header); err != nil {
+			t.Fatal(i, err)
+		}
+		if sz := int(binary.BigEndian.Uint16(header)); sz != len(p) {
+			t.Fatalf("packet %v size mismatch: %v, want %v", i, sz, len(p))
+		}
+		payload := make([]byte, len(p))
+		if _, err := io.ReadFull(client, payload); err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(payload, p) {
+			t.Fatalf("packet %v payload mismatch", i)
+		}
+	}
+	if n, err := client.Read(header); err != io.EOF {
+		t.Fatalf("unexpected trailing data: %v %v", n, err)
+	}
+
+	if !<-done {
+		t.Fatal("raw_send failed")
+	}
+	want := []int{65537, 3, 65537, 9}
+	if len(conn.writes) != len(want) {
+		t.Fatalf("writes: %v, want %v", conn.writes, want)
+	}
+	for i := range want {
+		if conn.writes[i] != want[i] {
+			t.Fatalf("writes: %v, want %v", conn.writes, want)
+		}
+	}
+	if n := metricPacketsOut.Value() - packetsOut; n != int64(len(packets)) {
+		t.Fatalf("packets_out: %v, want %v", n, len(packets))
+	}
+}
+
+func TestBufferRawSendError(t *testing.T) {
+	if err := initBuffer(time.Second, 16); err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	client.Close()
+	buf := new_buffer(server, make(chan struct{}))
+	if buf.raw_send([]byte{1, 2, 3}) {
+		t.Fatal("raw_send succeeded on a closed pipe")
+	}
+}
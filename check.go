@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+import (
+	"agent/misc/ipfilter"
+)
+
+// check-config command: validates all flags without starting the agent,
+// every error is reported and the exit code is non-zero if any.
+func checkConfig(c *cli.Context) error {
+	logConfig(c)
+
+	var errs []error
+	check := func(err error, what string) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", what, err))
+		}
+	}
+	positive := func(name string) {
+		if c.Int(name) <= 0 {
+			errs = append(errs, fmt.Errorf("%v: must be positive", name))
+		}
+	}
+
+	_, err := net.ResolveTCPAddr("tcp", c.String("listen"))
+	check(err, "listen(tcp)")
+	_, err = net.ResolveUDPAddr("udp", c.String("listen"))
+	check(err, "listen(udp)")
+	check(checkDebug(c.String("debug-listen"), c.String("debug-auth")), "debug-listen")
+
+	_, err = initTLS(c.String("tls-cert"), c.String("tls-key"), c.String("tls-client-ca"),
+		c.String("tls-min-version"), c.StringSlice("tls-ciphers"))
+	check(err, "tls")
+
+	_, err = ipfilter.New(c.StringSlice("ip-allow"), c.StringSlice("ip-deny"))
+	check(err, "ip filter")
+	_, err = initProxyFilter(c.Bool("proxy-protocol"), c.StringSlice("proxy-protocol-from"))
+	check(err, "proxy-protocol")
+
+	check(initBuffer(c.Duration("write-deadline"), c.Int("pending-limit")), "buffer")
+	for _, name := range []string{"sockbuf", "udp-sockbuf", "udp-sndwnd", "udp-rcvwnd", "rpm-limit"} {
+		positive(name)
+	}
+	check(checkUDP(c.Int("udp-mtu"), c.Int("udp-datashard"), c.Int("udp-parityshard")), "udp")
+	if c.Int("dscp") < 0 || c.Int("dscp") > 63 {
+		errs = append(errs, fmt.Errorf("dscp: must be 6 bits"))
+	}
+	if len(c.StringSlice("etcd-hosts")) == 0 {
+		errs = append(errs, fmt.Errorf("etcd-hosts: at least one host is required"))
+	}
+
+	for _, err := range errs {
+		log.Error(err)
+	}
+	if len(errs) > 0 {
+		return cli.Exit(fmt.Sprintf("%v error(s) in configuration", len(errs)), 1)
+	}
+	log.Info("configuration ok")
+	return nil
+}
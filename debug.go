@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+import (
+	"agent/utils"
+)
+
+var (
+	ERROR_DEBUG_AUTH   = errors.New("debug-auth must be user:password")
+	ERROR_DEBUG_PUBLIC = errors.New("debug-listen on a non-loopback address requires debug-auth")
+)
+
+// the debug listener exposes pprof & expvar, so it's either kept
+// on loopback or protected by a user & non-empty password.
+func checkDebug(addr, auth string) error {
+	if addr == "" {
+		return nil
+	}
+	if auth != "" {
+		if idx := strings.Index(auth, ":"); idx <= 0 || idx == len(auth)-1 {
+			return ERROR_DEBUG_AUTH
+		}
+		return nil
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tcpAddr.IP == nil || !tcpAddr.IP.IsLoopback() {
+		return ERROR_DEBUG_PUBLIC
+	}
+	return nil
+}
+
+// serve pprof, expvar & health checks registered on http.DefaultServeMux,
+// auth is "user:password" for basic authentication, empty to disable.
+// health checks are exempted from authentication, for orchestrator probes.
+func debugServer(addr, auth string) {
+	defer utils.PrintPanicStack()
+	var handler http.Handler = http.DefaultServeMux
+	if auth != "" {
+		handler = basic_auth(handler, auth)
+	}
+
+	log.Info("debug listening on:", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Error("debug server:", err)
+	}
+}
+
+func basic_auth(next http.Handler, auth string) http.Handler {
+	idx := strings.Index(auth, ":")
+	user, password := auth[:idx], auth[idx+1:]
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, p, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="agent"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
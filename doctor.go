@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+const (
+	DOCTOR_TIMEOUT    = 3 * time.Second
+	DOCTOR_MAX_SKEW   = 2 * time.Second
+	DOCTOR_CERT_GRACE = 14 * 24 * time.Hour
+	DOCTOR_MIN_NOFILE = 4096
+	UDP_IP_OVERHEAD   = 28 // ipv4 + udp header
+)
+
+// doctor command: inspects the host and its dependencies for the problems
+// most often seen in deployments, every finding is printed with a hint.
+func doctor(c *cli.Context) error {
+	var findings int
+	warn := func(format string, args ...interface{}) {
+		findings++
+		log.Warnf(format, args...)
+	}
+
+	// file descriptors, each client holds one
+	doctor_nofile(c.Int("max-conns"), warn)
+
+	// listen address, busy if another agent is running
+	if ln, err := net.Listen("tcp", c.String("listen")); err != nil {
+		warn("listen(tcp): %v", err)
+	} else {
+		ln.Close()
+	}
+	if conn, err := net.ListenPacket("udp", c.String("listen")); err != nil {
+		warn("listen(udp): %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// kcp packets larger than the path mtu are fragmented or dropped
+	maxMTU := 0
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 && iface.MTU > maxMTU {
+				maxMTU = iface.MTU
+			}
+		}
+	}
+	if maxMTU > 0 && c.Int("udp-mtu")+UDP_IP_OVERHEAD > maxMTU {
+		warn("udp-mtu: %v plus headers exceeds interface mtu %v, lower udp-mtu", c.Int("udp-mtu"), maxMTU)
+	}
+
+	// tls certificate validity against the local clock
+	if certFile := c.String("tls-cert"); certFile != "" {
+		if cert, err := tls.LoadX509KeyPair(certFile, c.String("tls-key")); err != nil {
+			warn("tls: %v", err)
+		} else if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			warn("tls: %v", err)
+		} else if now := time.Now(); now.Before(leaf.NotBefore) {
+			warn("tls: certificate not valid before %v, check the system clock", leaf.NotBefore)
+		} else if now.Add(DOCTOR_CERT_GRACE).After(leaf.NotAfter) {
+			warn("tls: certificate expires at %v", leaf.NotAfter)
+		} else {
+			log.Infof("tls: certificate valid until %v", leaf.NotAfter)
+		}
+	}
+
+	// etcd: dns, tcp and clock skew, each stage reported separately
+	client := &http.Client{Timeout: DOCTOR_TIMEOUT}
+	for _, host := range c.StringSlice("etcd-hosts") {
+		u, err := url.Parse(host)
+		if err != nil || u.Host == "" {
+			warn("etcd %v: invalid url", host)
+			continue
+		}
+		if _, err := net.LookupHost(u.Hostname()); err != nil {
+			warn("etcd %v: dns: %v", host, err)
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		addr := net.JoinHostPort(u.Hostname(), port)
+		conn, err := net.DialTimeout("tcp", addr, DOCTOR_TIMEOUT)
+		if err != nil {
+			warn("etcd %v: connect: %v", host, err)
+			continue
+		}
+		conn.Close()
+
+		resp, err := client.Get(host + "/version")
+		if err != nil {
+			warn("etcd %v: http: %v", host, err)
+			continue
+		}
+		resp.Body.Close()
+		if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			if skew := time.Since(date); skew > DOCTOR_MAX_SKEW || skew < -DOCTOR_MAX_SKEW {
+				warn("etcd %v: clock skew %v, check ntp", host, skew)
+			}
+		}
+		log.Infof("etcd %v: ok", host)
+	}
+
+	if findings > 0 {
+		return cli.Exit(fmt.Sprintf("%v finding(s)", findings), 1)
+	}
+	log.Info("no problems found")
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// compare the nofile soft limit with the expected connections
+func doctor_nofile(maxConns int, warn func(format string, args ...interface{})) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		warn("nofile: %v", err)
+		return
+	}
+
+	want := uint64(DOCTOR_MIN_NOFILE)
+	if maxConns > 0 && uint64(maxConns)+256 > want {
+		want = uint64(maxConns) + 256
+	}
+	// Cur is int64 on freebsd & dragonfly
+	cur := uint64(rlim.Cur)
+	if cur < want {
+		warn("nofile: soft limit %v is below %v, raise it with ulimit -n or LimitNOFILE=", cur, want)
+	} else {
+		log.Infof("nofile: %v", cur)
+	}
+}
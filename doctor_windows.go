@@ -0,0 +1,5 @@
+package main
+
+// windows has no per-process nofile limit to check
+func doctor_nofile(maxConns int, warn func(format string, args ...interface{})) {
+}
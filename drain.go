@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// in draining mode, new connections are refused while
+// existing sessions are served until they close by themselves,
+// e.g. before a maintenance window.
+var (
+	draining int32
+)
+
+// whether new connections are accepted
+func accepting() bool {
+	select {
+	case <-die:
+		return false
+	default:
+	}
+	return atomic.LoadInt32(&draining) == 0
+}
+
+// drain control on the debug listener, requires debug-auth
+//
+//	GET    /drain : report draining state & remaining connections
+//	POST   /drain : start draining
+//	DELETE /drain : stop draining
+func drain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if atomic.CompareAndSwapInt32(&draining, 0, 1) {
+			log.Info("draining started")
+		}
+	case "DELETE":
+		if atomic.CompareAndSwapInt32(&draining, 1, 0) {
+			log.Info("draining stopped")
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "draining:%v conns:%v\n", atomic.LoadInt32(&draining) == 1, metricConnsActive.Value())
+}
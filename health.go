@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+import (
+	"agent/services"
+)
+
+var (
+	startTime     = time.Now()
+	healthService []string // services required for readiness
+)
+
+// register health check handlers on the profiling port,
+// /healthz reports the process is alive, /readyz reports whether
+// the agent is accepting clients and every required service has a live instance.
+// /drain takes the agent out of service, so it's only registered
+// when the debug listener is protected by basic auth.
+func initHealth(names []string, drainable bool) {
+	healthService = names
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
+	if drainable {
+		http.HandleFunc("/drain", drain)
+	}
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok uptime:%v\n", time.Now().Sub(startTime))
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	report := ""
+	if !accepting() {
+		ready = false
+		report += "not accepting connections\n"
+	}
+
+	for _, name := range healthService {
+		n := services.Count(name)
+		if n == 0 {
+			ready = false
+		}
+		report += fmt.Sprintf("%v:%v\n", name, n)
+	}
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, report)
+}
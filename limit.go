@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+import (
+	"agent/misc/ipfilter"
+)
+
+var (
+	ERROR_NO_PROXY_FROM = errors.New("proxy-protocol requires proxy-protocol-from")
+)
+
+// concurrent connection limits, 0 means unlimited
+var (
+	maxConns      int
+	maxConnsPerIP int
+
+	conns      int
+	connsPerIP = make(map[string]int)
+	connsMu    sync.Mutex
+
+	// source ip filter
+	ipFilter *ipfilter.Filter
+)
+
+func initLimit(max_conns, max_conns_per_ip int) {
+	maxConns = max_conns
+	maxConnsPerIP = max_conns_per_ip
+}
+
+func initFilter(allow, deny []string) (err error) {
+	ipFilter, err = ipfilter.New(allow, deny)
+	return
+}
+
+// the senders trusted to provide PROXY protocol headers,
+// returns nil if PROXY protocol is disabled.
+func initProxyFilter(enabled bool, from []string) (*ipfilter.Filter, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if len(from) == 0 {
+		return nil, ERROR_NO_PROXY_FROM
+	}
+	return ipfilter.New(from, nil)
+}
+
+// check the source ip against allow/deny lists
+func filter_ip(ip net.IP) bool {
+	if ipFilter == nil {
+		return true
+	}
+	return ipFilter.Check(ip)
+}
+
+// the per-ip limit key, ipv6 addresses are grouped by /64,
+// since a single host usually owns a whole /64 to rotate through.
+func limit_key(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// try to take a connection slot for the ip
+func acquire_conn(ip net.IP) bool {
+	key := limit_key(ip)
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if maxConns > 0 && conns >= maxConns {
+		return false
+	}
+	if maxConnsPerIP > 0 && connsPerIP[key] >= maxConnsPerIP {
+		return false
+	}
+	conns++
+	connsPerIP[key]++
+	return true
+}
+
+// give back the slot taken by acquire_conn
+func release_conn(ip net.IP) {
+	key := limit_key(ip)
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	conns--
+	if connsPerIP[key]--; connsPerIP[key] <= 0 {
+		delete(connsPerIP, key)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLimitPerIP(t *testing.T) {
+	initLimit(0, 2)
+	defer initLimit(0, 0)
+
+	a := net.ParseIP("2001:db8:1:2::1")
+	b := net.ParseIP("2001:db8:1:2:ffff::2")
+	c := net.ParseIP("2001:db8:1:3::1")
+	if !acquire_conn(a) || !acquire_conn(b) {
+		t.Fatal("acquire failed under the limit")
+	}
+	if acquire_conn(net.ParseIP("2001:db8:1:2:abcd::3")) {
+		t.Fatal("same /64 is not limited")
+	}
+	if !acquire_conn(c) {
+		t.Fatal("another /64 is limited")
+	}
+	release_conn(a)
+	if !acquire_conn(a) {
+		t.Fatal("slot not released")
+	}
+
+	v4 := net.ParseIP("192.0.2.1")
+	if !acquire_conn(v4) || !acquire_conn(v4) || acquire_conn(v4) {
+		t.Fatal("ipv4 limit mismatch")
+	}
+	if !acquire_conn(net.ParseIP("192.0.2.2")) {
+		t.Fatal("ipv4 addresses are grouped")
+	}
+
+	for _, ip := range []net.IP{a, b, c, v4, v4, net.ParseIP("192.0.2.2")} {
+		release_conn(ip)
+	}
+	if conns != 0 || len(connsPerIP) != 0 {
+		t.Fatal("slots leaked:", conns, connsPerIP)
+	}
+}
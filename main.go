@@ -1,14 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
-	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"time"
 
+	"agent/misc/ipfilter"
+	"agent/misc/proxyproto"
 	. "agent/types"
 	"agent/utils"
 
@@ -23,18 +26,27 @@ func main() {
 	// to catch all uncaught panic
 	defer utils.PrintPanicStack()
 
-	// open profiling
-	go http.ListenAndServe("0.0.0.0:6060", nil)
 	app := &cli.App{
-		Name:    "agent",
-		Usage:   "a gateway for games with stream multiplexing",
-		Version: "2.0",
+		Name:                  "agent",
+		Usage:                 "a gateway for games with stream multiplexing",
+		Version:               "2.0",
+		EnableShellCompletion: true,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "listen",
 				Value: ":8888",
 				Usage: "listening address:port",
 			},
+			&cli.StringFlag{
+				Name:  "debug-listen",
+				Value: "127.0.0.1:6060",
+				Usage: "listening address:port for pprof/expvar/health check, empty to disable, non-loopback requires debug-auth",
+			},
+			&cli.StringFlag{
+				Name:  "debug-auth",
+				Value: "",
+				Usage: "user:password to protect the debug listener with basic auth, /drain is only enabled with it",
+			},
 			&cli.StringSliceFlag{
 				Name:  "etcd-hosts",
 				Value: cli.NewStringSlice("http://127.0.0.1:2379"),
@@ -55,11 +67,63 @@ func main() {
 				Value: 15 * time.Second,
 				Usage: "per connection read timeout",
 			},
+			&cli.StringFlag{
+				Name:  "tls-cert",
+				Value: "",
+				Usage: "certificate file for tcp listener, enables tls",
+			},
+			&cli.StringFlag{
+				Name:  "tls-key",
+				Value: "",
+				Usage: "private key file for tcp listener",
+			},
+			&cli.StringFlag{
+				Name:  "tls-client-ca",
+				Value: "",
+				Usage: "ca file to verify client certificates, enables mutual tls",
+			},
+			&cli.StringFlag{
+				Name:  "tls-min-version",
+				Value: "1.2",
+				Usage: "minimum tls version: 1.0, 1.1, 1.2 or 1.3",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tls-ciphers",
+				Usage: "allowed tls 1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			},
+			&cli.BoolFlag{
+				Name:  "proxy-protocol",
+				Usage: "expect PROXY protocol v1/v2 header on tcp connections",
+			},
+			&cli.StringSliceFlag{
+				Name:  "proxy-protocol-from",
+				Usage: "trusted load balancer addresses(CIDR) allowed to send PROXY headers, required with proxy-protocol",
+			},
+			&cli.DurationFlag{
+				Name:  "write-deadline",
+				Value: 15 * time.Second,
+				Usage: "per packet write timeout",
+			},
+			&cli.IntFlag{
+				Name:  "pending-limit",
+				Value: 128,
+				Usage: "per connection max pending outgoing packets",
+			},
 			&cli.IntFlag{
 				Name:  "sockbuf",
 				Value: 32767,
 				Usage: "per connection tcp socket buffer",
 			},
+			&cli.BoolFlag{
+				Name:  "tcp-nodelay",
+				Value: true,
+				Usage: "set TCP_NODELAY on tcp connections",
+			},
+			&cli.DurationFlag{
+				Name:  "tcp-keepalive",
+				Value: 0,
+				Usage: "tcp keepalive period, 0 keeps go's default(15s), negative to disable",
+			},
 			&cli.IntFlag{
 				Name:  "udp-sockbuf",
 				Value: 4194304,
@@ -78,7 +142,17 @@ func main() {
 			&cli.IntFlag{
 				Name:  "udp-mtu",
 				Value: 1350,
-				Usage: "MTU of UDP packets",
+				Usage: "MTU of UDP packets, 64-1500",
+			},
+			&cli.IntFlag{
+				Name:  "udp-datashard",
+				Value: 0,
+				Usage: "reed-solomon erasure coding - datashard, 0 to disable fec, set together with parityshard",
+			},
+			&cli.IntFlag{
+				Name:  "udp-parityshard",
+				Value: 0,
+				Usage: "reed-solomon erasure coding - parityshard, 0 to disable fec, set together with datashard",
 			},
 			&cli.IntFlag{
 				Name:  "dscp",
@@ -110,21 +184,44 @@ func main() {
 				Value: 200,
 				Usage: "per connection rpm limit",
 			},
+			&cli.StringSliceFlag{
+				Name:  "ip-allow",
+				Usage: "accept connections only from these ips or CIDRs",
+			},
+			&cli.StringSliceFlag{
+				Name:  "ip-deny",
+				Usage: "refuse connections from these ips or CIDRs",
+			},
+			&cli.IntFlag{
+				Name:  "max-conns",
+				Value: 0,
+				Usage: "max concurrent connections, 0 for unlimited",
+			},
+			&cli.IntFlag{
+				Name:  "max-conns-per-ip",
+				Value: 0,
+				Usage: "max concurrent connections from a single ip(or ipv6 /64), 0 for unlimited",
+			},
+			&cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Value: 30 * time.Second,
+				Usage: "max time to wait for sessions to close on SIGTERM",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:   "check-config",
+				Usage:  "validate the configuration and exit",
+				Action: checkConfig,
+			},
+			{
+				Name:   "doctor",
+				Usage:  "diagnose common deployment problems and exit",
+				Action: doctor,
+			},
 		},
 		Action: func(c *cli.Context) error {
-			log.Println("listen:", c.String("listen"))
-			log.Println("etcd-hosts:", c.StringSlice("etcd-hosts"))
-			log.Println("etcd-root:", c.String("etcd-root"))
-			log.Println("services:", c.StringSlice("services"))
-			log.Println("read-deadline:", c.Duration("read-deadline"))
-			log.Println("sockbuf:", c.Int("sockbuf"))
-			log.Println("udp-sockbuf:", c.Int("udp-sockbuf"))
-			log.Println("udp-sndwnd:", c.Int("udp-sndwnd"))
-			log.Println("udp-rcvwnd:", c.Int("udp-rcvwnd"))
-			log.Println("udp-mtu:", c.Int("udp-mtu"))
-			log.Println("dscp:", c.Int("dscp"))
-			log.Println("rpm-limit:", c.Int("rpm-limit"))
-			log.Println("nodelay parameters:", c.Int("nodelay"), c.Int("interval"), c.Int("resend"), c.Int("nc"))
+			logConfig(c)
 
 			//setup net param
 			listen := c.String("listen")
@@ -135,16 +232,40 @@ func main() {
 			sndwnd := c.Int("udp-sndwnd")
 			rcvwnd := c.Int("udp-rcvwnd")
 			mtu := c.Int("udp-mtu")
+			datashard, parityshard := c.Int("udp-datashard"), c.Int("udp-parityshard")
 			nodelay, interval, resend, nc := c.Int("nodelay"), c.Int("interval"), c.Int("resend"), c.Int("nc")
+			checkError(checkUDP(mtu, datashard, parityshard))
+			tlsConfig, err := initTLS(c.String("tls-cert"), c.String("tls-key"), c.String("tls-client-ca"),
+				c.String("tls-min-version"), c.StringSlice("tls-ciphers"))
+			checkError(err)
+			proxyFrom, err := initProxyFilter(c.Bool("proxy-protocol"), c.StringSlice("proxy-protocol-from"))
+			checkError(err)
 
+			// open profiling
+			checkError(checkDebug(c.String("debug-listen"), c.String("debug-auth")))
+			if addr := c.String("debug-listen"); addr != "" {
+				go debugServer(addr, c.String("debug-auth"))
+			}
 			// init services
 			startup(c)
 			// init timer
 			initTimer(c.Int("rpm-limit"))
+			// init connection limits
+			initLimit(c.Int("max-conns"), c.Int("max-conns-per-ip"))
+			checkError(initFilter(c.StringSlice("ip-allow"), c.StringSlice("ip-deny")))
+			// init health check
+			initHealth(c.StringSlice("services"), c.String("debug-auth") != "")
+			// init write buffer
+			checkError(initBuffer(c.Duration("write-deadline"), c.Int("pending-limit")))
+
+			// listeners, bound before reporting readiness
+			initActivation()
+			tcpListener := listenTCP(listen)
+			udpListener := listenUDP(listen, udp_sockbuf, dscp, datashard, parityshard)
+			go tcpServer(tcpListener, readDeadline, sockbuf, c.Bool("tcp-nodelay"), c.Duration("tcp-keepalive"), tlsConfig, proxyFrom)
+			go udpServer(udpListener, readDeadline, sndwnd, rcvwnd, nodelay, interval, resend, nc, mtu)
 
-			// listeners
-			go tcpServer(listen, readDeadline, sockbuf)
-			go udpServer(listen, readDeadline, udp_sockbuf, dscp, sndwnd, rcvwnd, nodelay, interval, resend, nc, mtu)
+			notifyReady()
 
 			// wait forever
 			select {}
@@ -153,38 +274,161 @@ func main() {
 	app.Run(os.Args)
 }
 
-func tcpServer(addr string, readDeadline time.Duration, sockbuf int) {
-	// resolve address & start listening
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
-	checkError(err)
+// print the effective configuration
+func logConfig(c *cli.Context) {
+	log.Println("listen:", c.String("listen"))
+	log.Println("debug-listen:", c.String("debug-listen"))
+	log.Println("debug-auth:", c.String("debug-auth") != "")
+	log.Println("etcd-hosts:", c.StringSlice("etcd-hosts"))
+	log.Println("etcd-root:", c.String("etcd-root"))
+	log.Println("services:", c.StringSlice("services"))
+	log.Println("read-deadline:", c.Duration("read-deadline"))
+	log.Println("write-deadline:", c.Duration("write-deadline"))
+	log.Println("pending-limit:", c.Int("pending-limit"))
+	log.Println("tls-cert:", c.String("tls-cert"))
+	log.Println("tls-key:", c.String("tls-key"))
+	log.Println("tls-client-ca:", c.String("tls-client-ca"))
+	log.Println("tls-min-version:", c.String("tls-min-version"))
+	log.Println("tls-ciphers:", c.StringSlice("tls-ciphers"))
+	log.Println("proxy-protocol:", c.Bool("proxy-protocol"))
+	log.Println("proxy-protocol-from:", c.StringSlice("proxy-protocol-from"))
+	log.Println("sockbuf:", c.Int("sockbuf"))
+	log.Println("tcp-nodelay:", c.Bool("tcp-nodelay"))
+	log.Println("tcp-keepalive:", c.Duration("tcp-keepalive"))
+	log.Println("udp-sockbuf:", c.Int("udp-sockbuf"))
+	log.Println("udp-sndwnd:", c.Int("udp-sndwnd"))
+	log.Println("udp-rcvwnd:", c.Int("udp-rcvwnd"))
+	log.Println("udp-mtu:", c.Int("udp-mtu"))
+	log.Println("udp-datashard:", c.Int("udp-datashard"))
+	log.Println("udp-parityshard:", c.Int("udp-parityshard"))
+	log.Println("dscp:", c.Int("dscp"))
+	log.Println("rpm-limit:", c.Int("rpm-limit"))
+	log.Println("ip-allow:", c.StringSlice("ip-allow"))
+	log.Println("ip-deny:", c.StringSlice("ip-deny"))
+	log.Println("max-conns:", c.Int("max-conns"))
+	log.Println("max-conns-per-ip:", c.Int("max-conns-per-ip"))
+	log.Println("shutdown-timeout:", c.Duration("shutdown-timeout"))
+	log.Println("nodelay parameters:", c.Int("nodelay"), c.Int("interval"), c.Int("resend"), c.Int("nc"))
+}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	checkError(err)
+// bind the tcp listening address, or take the activated socket
+func listenTCP(addr string) *net.TCPListener {
+	listener := activatedTCP
+	if listener == nil {
+		// resolve address & start listening
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		checkError(err)
+
+		listener, err = net.ListenTCP("tcp", tcpAddr)
+		checkError(err)
+	}
 
 	log.Info("listening on:", listener.Addr())
+	return listener
+}
+
+func tcpServer(listener *net.TCPListener, readDeadline time.Duration,
+	sockbuf int, nodelay bool, keepalive time.Duration,
+	tlsConfig *tls.Config, proxyFrom *ipfilter.Filter) {
+	// stop accepting new connections on server shutdown
+	go func() {
+		<-die
+		listener.Close()
+	}()
 
 	// loop accepting
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
+			select {
+			case <-die:
+				return
+			default:
+			}
 			log.Warning("accept failed:", err)
 			continue
 		}
+		if !accepting() {
+			conn.Close()
+			continue
+		}
 		// set socket read buffer
 		conn.SetReadBuffer(sockbuf)
 		// set socket write buffer
 		conn.SetWriteBuffer(sockbuf)
+		// small game packets shouldn't wait for nagle
+		conn.SetNoDelay(nodelay)
+		// detect dead peers at tcp level
+		if keepalive > 0 {
+			conn.SetKeepAlive(true)
+			conn.SetKeepAlivePeriod(keepalive)
+		} else if keepalive < 0 {
+			conn.SetKeepAlive(false)
+		}
 		// start a goroutine for every incoming connection for reading
-		go handleClient(conn, readDeadline)
+		go handleTCPClient(conn, readDeadline, tlsConfig, proxyFrom)
 	}
 }
 
-func udpServer(addr string, readDeadline time.Duration,
-	sockbuf, dscp, sndwnd, rcvwnd,
-	nodelay, interval, resend, nc,
-	mtu int) {
+// unwrap PROXY protocol & tls layers, in the order they're sent on the wire,
+// proxyFrom is nil if PROXY protocol is disabled.
+func handleTCPClient(conn *net.TCPConn, readDeadline time.Duration, tlsConfig *tls.Config, proxyFrom *ipfilter.Filter) {
+	defer utils.PrintPanicStack()
+	var c net.Conn = conn
+	if proxyFrom != nil {
+		// the header decides the client address used by ip filter & limits,
+		// so it's only believed from the load balancers.
+		if !proxyFrom.Check(conn.RemoteAddr().(*net.TCPAddr).IP) {
+			log.Warningf("untrusted proxy protocol sender, refused:%v", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		pconn, err := proxyproto.NewConn(conn, readDeadline)
+		if err != nil {
+			log.Warningf("read proxy protocol header failed, addr:%v reason:%v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		c = pconn
+	}
+	if tlsConfig != nil {
+		c = tls.Server(c, tlsConfig)
+	}
+	handleClient(c, readDeadline)
+}
+
+// kcp-go refuses mtu above 1500, and silently ignores values too small
+// to carry a segment after the fec header.
+const (
+	UDP_MTU_MIN = 64
+	UDP_MTU_MAX = 1500
+)
+
+var (
+	ERROR_UDP_MTU = errors.New("udp-mtu out of range")
+	ERROR_UDP_FEC = errors.New("udp-datashard and udp-parityshard must be set together")
+)
 
-	l, err := kcp.Listen(addr)
+// validate the kcp settings which would otherwise be ignored per session
+func checkUDP(mtu, datashard, parityshard int) error {
+	if mtu < UDP_MTU_MIN || mtu > UDP_MTU_MAX {
+		return ERROR_UDP_MTU
+	}
+	if datashard < 0 || parityshard < 0 || (datashard > 0) != (parityshard > 0) {
+		return ERROR_UDP_FEC
+	}
+	return nil
+}
+
+// bind the udp listening address, or take the activated socket
+func listenUDP(addr string, sockbuf, dscp, datashard, parityshard int) *kcp.Listener {
+	var l net.Listener
+	var err error
+	if activatedUDP != nil {
+		l, err = kcp.ServeConn(nil, datashard, parityshard, activatedUDP)
+	} else {
+		l, err = kcp.ListenWithOptions(addr, nil, datashard, parityshard)
+	}
 	checkError(err)
 	log.Info("udp listening on:", l.Addr())
 	lis := l.(*kcp.Listener)
@@ -198,7 +442,13 @@ func udpServer(addr string, readDeadline time.Duration,
 	if err := lis.SetDSCP(dscp); err != nil {
 		log.Println("SetDSCP", err)
 	}
+	return lis
+}
 
+func udpServer(lis *kcp.Listener, readDeadline time.Duration,
+	sndwnd, rcvwnd,
+	nodelay, interval, resend, nc,
+	mtu int) {
 	// loop accepting
 	for {
 		conn, err := lis.AcceptKCP()
@@ -206,9 +456,18 @@ func udpServer(addr string, readDeadline time.Duration,
 			log.Warning("accept failed:", err)
 			continue
 		}
+		// the udp socket is shared by all kcp sessions, so the listener
+		// is kept open on shutdown and new sessions are refused instead.
+		if !accepting() {
+			conn.Close()
+			continue
+		}
 		// set kcp parameters
 		conn.SetWindowSize(sndwnd, rcvwnd)
 		conn.SetNoDelay(nodelay, interval, resend, nc)
+		if !conn.SetMtu(mtu) {
+			log.Warning("SetMtu failed:", mtu)
+		}
 		conn.SetStreamMode(true)
 
 		// start a goroutine for every incoming connection for reading
@@ -240,7 +499,21 @@ func handleClient(conn net.Conn, readDeadline time.Duration) {
 		return
 	}
 	sess.IP = net.ParseIP(host)
+	if !filter_ip(sess.IP) {
+		log.Warningf("ip filtered, refused:%v port:%v", host, port)
+		conn.Close()
+		return
+	}
+	if !acquire_conn(sess.IP) {
+		log.Warningf("too many connections, refused:%v port:%v", host, port)
+		conn.Close()
+		return
+	}
+	defer release_conn(sess.IP)
 	log.Infof("new connection from:%v port:%v", host, port)
+	metricConnsTotal.Add(1)
+	metricConnsActive.Add(1)
+	defer metricConnsActive.Add(-1)
 
 	// session die signal, will be triggered by agent()
 	sess.Die = make(chan struct{})
@@ -275,6 +548,8 @@ func handleClient(conn net.Conn, readDeadline time.Duration) {
 			log.Warningf("read payload failed, ip:%v reason:%v size:%v", sess.IP, err, n)
 			return
 		}
+		metricPacketsIn.Add(1)
+		metricBytesIn.Add(int64(size) + 2)
 
 		// deliver the data to the input queue of agent()
 		select {
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+)
+
+// runtime counters, exported at /debug/vars on the profiling port
+var (
+	metricConnsActive = expvar.NewInt("conns_active") // currently open connections
+	metricConnsTotal  = expvar.NewInt("conns_total")  // connections accepted since startup
+	metricPacketsIn   = expvar.NewInt("packets_in")   // packets received from clients
+	metricPacketsOut  = expvar.NewInt("packets_out")  // packets sent to clients
+	metricBytesIn     = expvar.NewInt("bytes_in")     // bytes received from clients, including headers
+	metricBytesOut    = expvar.NewInt("bytes_out")    // bytes sent to clients, including headers
+)
+
+func init() {
+	// compared with conns_active, a steady growth indicates goroutine leaks,
+	// the stacks can be inspected at /debug/pprof/goroutine
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
@@ -0,0 +1,79 @@
+// source ip filtering with CIDR allow/deny lists
+//
+// deny rules take precedence, if any allow rule is given,
+// only the matching ips are accepted.
+package ipfilter
+
+import (
+	"net"
+	"strings"
+)
+
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// create a filter from CIDR notations("10.0.0.0/8", "2001:db8::/32"),
+// a bare ip is treated as a single host.
+func New(allow, deny []string) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	if f.allow, err = parse(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parse(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// check whether the ip is accepted
+func (f *Filter) Check(ip net.IP) bool {
+	if match(f.deny, ip) {
+		return false
+	}
+	if len(f.allow) > 0 {
+		return match(f.allow, ip)
+	}
+	return true
+}
+
+func match(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(rules []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if !strings.Contains(rule, "/") {
+			// by the parsed form, so ipv4-mapped literals(::ffff:10.0.0.1)
+			// match the ipv4 host
+			ip := net.ParseIP(rule)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: rule}
+			}
+			if v4 := ip.To4(); v4 != nil {
+				nets = append(nets, &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,56 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := New([]string{"10.0.0.0/8", "192.168.1.1", "::ffff:172.16.0.1", "2001:db8::/32"}, []string{"10.0.0.1", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"10.0.0.2":    true,
+		"10.0.0.1":    false,
+		"10.1.2.3":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"172.16.0.1":  true,
+		"172.16.0.2":  false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"8.8.8.8":     false,
+	}
+	for ip, expect := range cases {
+		if f.Check(net.ParseIP(ip)) != expect {
+			t.Errorf("ip:%v should be %v", ip, expect)
+		}
+	}
+}
+
+func TestDenyOnly(t *testing.T) {
+	f, err := New(nil, []string{"1.2.3.0/24", "::1", "::ffff:10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Check(net.ParseIP("1.2.3.4")) || f.Check(net.ParseIP("::1")) {
+		t.Error("denied ip accepted")
+	}
+	if f.Check(net.ParseIP("10.0.0.1")) || f.Check(net.ParseIP("::ffff:10.0.0.1")) {
+		t.Error("ipv4-mapped deny not applied")
+	}
+	if !f.Check(net.ParseIP("1.2.4.1")) || !f.Check(net.ParseIP("10.0.0.2")) {
+		t.Error("ip should be accepted without allow rules")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("invalid cidr should fail")
+	}
+	if _, err := New(nil, []string{"not-an-ip"}); err == nil {
+		t.Error("invalid ip should fail")
+	}
+}
@@ -0,0 +1,169 @@
+// PROXY protocol v1/v2 receiver
+//
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+//
+// when the agent sits behind a load balancer(haproxy, aws nlb...), the
+// header sent by the balancer carries the real address of the client.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	V1_MAX_LENGTH = 107 // including CRLF
+	V2_HEADER_LEN = 16
+)
+
+var (
+	V1_SIGNATURE = []byte("PROXY ")
+	V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var (
+	ERROR_NO_HEADER      = errors.New("proxy protocol header not found")
+	ERROR_INVALID_HEADER = errors.New("invalid proxy protocol header")
+	ERROR_UNSUPPORTED    = errors.New("unsupported proxy protocol address family")
+)
+
+// Conn overrides RemoteAddr with the source address in the PROXY header
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// read the PROXY header from conn within timeout, the header is mandatory.
+func NewConn(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	remote, err := ReadHeader(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// read a v1 or v2 header, returns the source address, or nil if
+// the header doesn't carry one(LOCAL command, UNKNOWN protocol).
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(V2_SIGNATURE)); err == nil && bytes.Equal(sig, V2_SIGNATURE) {
+		return read_v2(r)
+	}
+	if sig, err := r.Peek(len(V1_SIGNATURE)); err == nil && bytes.Equal(sig, V1_SIGNATURE) {
+		return read_v1(r)
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, ERROR_NO_HEADER
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func read_v1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= V1_MAX_LENGTH {
+			return nil, ERROR_INVALID_HEADER
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ERROR_INVALID_HEADER
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, ERROR_INVALID_HEADER
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ERROR_UNSUPPORTED
+	}
+
+	if len(fields) != 6 {
+		return nil, ERROR_INVALID_HEADER
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ERROR_INVALID_HEADER
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ERROR_INVALID_HEADER
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// | 12B signature | 1B ver_cmd | 1B fam | 2B len | addresses ... |
+func read_v2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, V2_HEADER_LEN)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	ver_cmd, fam := header[12], header[13]
+	size := binary.BigEndian.Uint16(header[14:])
+	if ver_cmd>>4 != 2 {
+		return nil, ERROR_INVALID_HEADER
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch ver_cmd & 0xF {
+	case 0: // LOCAL, e.g health checks from the balancer
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, ERROR_INVALID_HEADER
+	}
+
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, ERROR_INVALID_HEADER
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, ERROR_INVALID_HEADER
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	case 0x00: // UNSPEC
+		return nil, nil
+	}
+	return nil, ERROR_UNSUPPORTED
+}
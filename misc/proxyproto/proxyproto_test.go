@@ -0,0 +1,114 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestV1(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nDATA"))
+	addr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr := addr.(*net.TCPAddr)
+	if !tcpAddr.IP.Equal(net.ParseIP("192.168.0.1")) || tcpAddr.Port != 56324 {
+		t.Error("v1 source address mismatch:", addr)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "DATA" {
+		t.Error("v1 payload mismatch:", rest)
+	}
+
+	r = bufio.NewReader(bytes.NewBufferString("PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n"))
+	addr, err = ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.(*net.TCPAddr).IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Error("v1 ipv6 source address mismatch:", addr)
+	}
+
+	r = bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n"))
+	if addr, err := ReadHeader(r); err != nil || addr != nil {
+		t.Error("v1 unknown should return nil address:", addr, err)
+	}
+}
+
+func TestV1Invalid(t *testing.T) {
+	for _, h := range []string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n",
+		"PROXY " + string(bytes.Repeat([]byte("A"), V1_MAX_LENGTH)) + "\r\n",
+		"GET / HTTP/1.1\r\n",
+	} {
+		if _, err := ReadHeader(bufio.NewReader(bytes.NewBufferString(h))); err == nil {
+			t.Errorf("header %q should be rejected", h)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(V2_SIGNATURE)
+	buf.Write([]byte{0x21, 0x11, 0, 12})
+	buf.Write([]byte{10, 0, 0, 1, 10, 0, 0, 2, 0x1F, 0x90, 0x01, 0xBB})
+	buf.WriteString("DATA")
+
+	r := bufio.NewReader(&buf)
+	addr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr := addr.(*net.TCPAddr)
+	if !tcpAddr.IP.Equal(net.ParseIP("10.0.0.1")) || tcpAddr.Port != 8080 {
+		t.Error("v2 source address mismatch:", addr)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "DATA" {
+		t.Error("v2 payload mismatch:", rest)
+	}
+
+	// LOCAL command
+	buf.Reset()
+	buf.Write(V2_SIGNATURE)
+	buf.Write([]byte{0x20, 0x00, 0, 0})
+	if addr, err := ReadHeader(bufio.NewReader(&buf)); err != nil || addr != nil {
+		t.Error("v2 local should return nil address:", addr, err)
+	}
+
+	// truncated addresses
+	buf.Reset()
+	buf.Write(V2_SIGNATURE)
+	buf.Write([]byte{0x21, 0x21, 0, 12})
+	buf.Write(make([]byte, 12))
+	if _, err := ReadHeader(bufio.NewReader(&buf)); err == nil {
+		t.Error("truncated v2 ipv6 header should be rejected")
+	}
+}
+
+func TestConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		c1.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nhello"))
+		c1.Close()
+	}()
+
+	conn, err := NewConn(c2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "1.2.3.4:1111" {
+		t.Error("remote address mismatch:", conn.RemoteAddr())
+	}
+	data, _ := ioutil.ReadAll(conn)
+	if string(data) != "hello" {
+		t.Error("data mismatch:", data)
+	}
+}
@@ -0,0 +1,78 @@
+// systemd integration
+//
+// socket activation: https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+// notification:      https://www.freedesktop.org/software/systemd/man/sd_notify.html
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	LISTEN_FDS_START = 3
+)
+
+const (
+	READY     = "READY=1"
+	STOPPING  = "STOPPING=1"
+	RELOADING = "RELOADING=1"
+	WATCHDOG  = "WATCHDOG=1"
+)
+
+// files passed by socket activation, nil if not activated by systemd.
+// the environment variables are unset, so child processes won't inherit them.
+func Files() []*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil
+	}
+
+	files := make([]*os.File, 0, nfds)
+	for fd := LISTEN_FDS_START; fd < LISTEN_FDS_START+nfds; fd++ {
+		files = append(files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+	}
+	return files
+}
+
+// send state to the service manager, it's a no-op
+// if not running under systemd(NOTIFY_SOCKET not set)
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// the interval for sending WATCHDOG=1, zero if the watchdog is disabled.
+// half of WATCHDOG_USEC is returned, as recommended.
+func WatchdogInterval() time.Duration {
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,78 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", addr)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(READY); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != READY {
+		t.Error("notify state mismatch:", string(buf[:n]))
+	}
+}
+
+func TestNotifyNoSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(READY); err != nil {
+		t.Error("notify without socket should be no-op:", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if files := Files(); files != nil {
+		t.Error("files for another pid should be ignored")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS should be unset")
+	}
+
+	if files := Files(); files != nil {
+		t.Error("not activated, should return nil")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	os.Setenv("WATCHDOG_USEC", "10000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if d := WatchdogInterval(); d != 5*time.Second {
+		t.Error("watchdog interval mismatch:", d)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	defer os.Unsetenv("WATCHDOG_PID")
+	if d := WatchdogInterval(); d != 0 {
+		t.Error("watchdog for another pid should be disabled:", d)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	cli "gopkg.in/urfave/cli.v2"
 
@@ -15,9 +16,14 @@ import (
 	"google.golang.org/grpc"
 )
 
+import (
+	"agent/utils"
+)
+
 // a single connection
 type client struct {
 	key  string
+	addr string
 	conn *grpc.ClientConn
 }
 
@@ -35,6 +41,7 @@ type service_pool struct {
 	names_provided bool
 	client         etcdclient.Client
 	callbacks      map[string][]chan string
+	dialing        map[string]string // instances not yet connected, key -> address
 	mu             sync.RWMutex
 }
 
@@ -43,6 +50,30 @@ var (
 	once          sync.Once
 )
 
+const (
+	RETRY_MIN    = 100 * time.Millisecond
+	RETRY_MAX    = 30 * time.Second
+	DIAL_TIMEOUT = 5 * time.Second
+)
+
+// exponential backoff for retrying etcd requests & service dials
+type backoff struct {
+	d time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.d == 0 {
+		b.d = RETRY_MIN
+	} else if b.d *= 2; b.d > RETRY_MAX {
+		b.d = RETRY_MAX
+	}
+	return b.d
+}
+
+func (b *backoff) reset() {
+	b.d = 0
+}
+
 func Init(c *cli.Context) {
 	once.Do(func() { _default_pool.init(c) })
 }
@@ -64,6 +95,7 @@ func (p *service_pool) init(c *cli.Context) {
 	// init
 	p.services = make(map[string]*service)
 	p.names = make(map[string]bool)
+	p.dialing = make(map[string]string)
 
 	// names init
 	names := c.StringSlice("services")
@@ -77,17 +109,23 @@ func (p *service_pool) init(c *cli.Context) {
 	}
 
 	// start connection
-	p.connect_all(p.root)
+	p.connect_all(p.root, &backoff{})
 }
 
-// connect to all services
-func (p *service_pool) connect_all(directory string) {
+// connect to all services,
+// retried in background if etcd is not reachable.
+func (p *service_pool) connect_all(directory string, b *backoff) {
 	kAPI := etcdclient.NewKeysAPI(p.client)
 	// get the keys under directory
 	log.Println("connecting services under:", directory)
 	resp, err := kAPI.Get(context.Background(), directory, &etcdclient.GetOptions{Recursive: true})
 	if err != nil {
-		log.Println(err)
+		d := b.next()
+		log.Println(err, "retry in:", d)
+		time.AfterFunc(d, func() {
+			defer utils.PrintPanicStack()
+			p.connect_all(directory, b)
+		})
 		return
 	}
 
@@ -113,12 +151,17 @@ func (p *service_pool) connect_all(directory string) {
 func (p *service_pool) watcher() {
 	kAPI := etcdclient.NewKeysAPI(p.client)
 	w := kAPI.Watcher(p.root, &etcdclient.WatcherOptions{Recursive: true})
+	var b backoff
 	for {
 		resp, err := w.Next(context.Background())
 		if err != nil {
-			log.Println(err)
+			// avoid hammering etcd while it's down
+			d := b.next()
+			log.Println(err, "retry in:", d)
+			time.Sleep(d)
 			continue
 		}
+		b.reset()
 		if resp.Node.Dir {
 			continue
 		}
@@ -126,40 +169,90 @@ func (p *service_pool) watcher() {
 		switch resp.Action {
 		case "set", "create", "update", "compareAndSwap":
 			p.add_service(resp.Node.Key, resp.Node.Value)
-		case "delete":
-			p.remove_service(resp.PrevNode.Key)
+		case "delete", "compareAndDelete", "expire":
+			p.remove_service(resp.Node.Key)
 		}
 	}
 }
 
 // add a service
 func (p *service_pool) add_service(key, value string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
 	// name check
 	service_name := filepath.Dir(key)
 	if p.names_provided && !p.names[service_name] {
 		return
 	}
 
+	// already connected or being retried, e.g. a ttl refresh
+	p.mu.Lock()
+	if p.dialing[key] == value || p.connected(service_name, key, value) {
+		p.mu.Unlock()
+		return
+	}
+	p.dialing[key] = value
+	p.mu.Unlock()
+	p.dial(key, value, &backoff{})
+}
+
+// whether the instance is in the pool with the same address
+func (p *service_pool) connected(service_name, key, value string) bool {
+	if service := p.services[service_name]; service != nil {
+		for k := range service.clients {
+			if service.clients[k].key == key && service.clients[k].addr == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// create service connection without holding the lock,
+// a failed instance is retried in background with backoff,
+// until connected or removed(or changed) in etcd.
+func (p *service_pool) dial(key, value string, b *backoff) {
+	conn, err := grpc.Dial(value, grpc.WithBlock(), grpc.WithInsecure(), grpc.WithTimeout(DIAL_TIMEOUT))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dialing[key] != value {
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		d := b.next()
+		log.Println("did not connect:", key, "-->", value, "error:", err, "retry in:", d)
+		time.AfterFunc(d, func() {
+			defer utils.PrintPanicStack()
+			p.dial(key, value, b)
+		})
+		return
+	}
+	delete(p.dialing, key)
+
 	// try new service kind init
+	service_name := filepath.Dir(key)
 	if p.services[service_name] == nil {
 		p.services[service_name] = &service{}
 	}
 
-	// create service connection
+	// an instance changing its address replaces the old connection
 	service := p.services[service_name]
-	if conn, err := grpc.Dial(value, grpc.WithBlock(), grpc.WithInsecure()); err == nil {
-		service.clients = append(service.clients, client{key, conn})
-		log.Println("service added:", key, "-->", value)
-		for k := range p.callbacks[service_name] {
-			select {
-			case p.callbacks[service_name][k] <- key:
-			default:
-			}
+	for k := range service.clients {
+		if service.clients[k].key == key {
+			service.clients[k].conn.Close()
+			service.clients = append(service.clients[:k], service.clients[k+1:]...)
+			break
+		}
+	}
+	service.clients = append(service.clients, client{key, value, conn})
+	log.Println("service added:", key, "-->", value)
+	for k := range p.callbacks[service_name] {
+		select {
+		case p.callbacks[service_name][k] <- key:
+		default:
 		}
-	} else {
-		log.Println("did not connect:", key, "-->", value, "error:", err)
 	}
 }
 
@@ -173,6 +266,9 @@ func (p *service_pool) remove_service(key string) {
 		return
 	}
 
+	// stop retrying if not yet connected
+	delete(p.dialing, key)
+
 	// check service kind
 	service := p.services[service_name]
 	if service == nil {
@@ -239,6 +335,17 @@ func (p *service_pool) get_service(path string) (conn *grpc.ClientConn, key stri
 	return service.clients[idx].conn, service.clients[idx].key
 }
 
+// number of connected instances of a service
+func (p *service_pool) count(path string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	service := p.services[path]
+	if service == nil {
+		return 0
+	}
+	return len(service.clients)
+}
+
 func (p *service_pool) register_callback(path string, callback chan string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -269,6 +376,10 @@ func GetServiceWithId(path string, id string) *grpc.ClientConn {
 	return _default_pool.get_service_with_id(_default_pool.root+"/"+path, id)
 }
 
+func Count(path string) int {
+	return _default_pool.count(_default_pool.root + "/" + path)
+}
+
 func RegisterCallback(path string, callback chan string) {
 	_default_pool.register_callback(_default_pool.root+"/"+path, callback)
 }
@@ -5,11 +5,13 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 import (
+	"agent/misc/systemd"
 	"agent/utils"
 )
 
@@ -20,21 +22,36 @@ var (
 )
 
 // handle unix signals
-func sig_handler() {
+func sig_handler(timeout time.Duration) {
 	defer utils.PrintPanicStack()
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGTERM)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		msg := <-ch
 		switch msg {
 		case syscall.SIGTERM: // 关闭agent
+			systemd.Notify(systemd.STOPPING)
 			close(die)
 			log.Info("sigterm received")
 			log.Info("waiting for agents close, please wait...")
-			wg.Wait()
-			log.Info("agent shutdown.")
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				log.Info("agent shutdown.")
+			case <-time.After(timeout):
+				log.Warning("shutdown timeout, force exit.")
+			}
 			os.Exit(0)
+		case syscall.SIGHUP: // 重新加载证书
+			log.Info("sighup received")
+			systemd.Notify(systemd.RELOADING)
+			reloadTLS()
+			systemd.Notify(systemd.READY)
 		}
 	}
 }
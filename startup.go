@@ -7,6 +7,6 @@ import (
 )
 
 func startup(c *cli.Context) {
-	go sig_handler()
+	go sig_handler(c.Duration("shutdown-timeout"))
 	services.Init(c)
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ERROR_NO_CA_CERTS     = errors.New("no certificates found in client ca file")
+	ERROR_TLS_NO_CERT     = errors.New("tls-key and tls-client-ca require tls-cert")
+	ERROR_TLS_VERSION     = errors.New("unknown tls version")
+	ERROR_TLS_CIPHERSUITE = errors.New("unknown, insecure or tls 1.3 only cipher suite")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tls certificate for the tcp listener, reloadable at runtime
+type cert_store struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	mu       sync.RWMutex
+}
+
+var (
+	_default_certs *cert_store
+)
+
+// load (or reload) the certificate/key pair from disk
+func (s *cert_store) load() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *cert_store) get_certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// create the tls config for the tcp listener,
+// returns nil if tls is not enabled(no certificate specified),
+// a key or client ca without certificate is an error.
+// if caFile is set, clients must present a certificate signed by it.
+// ciphers restricts the cipher suites of TLS 1.2 and below by name,
+// TLS 1.3 suites are not configurable.
+func initTLS(certFile, keyFile, caFile, minVersion string, ciphers []string) (*tls.Config, error) {
+	if certFile == "" {
+		if keyFile != "" || caFile != "" {
+			return nil, ERROR_TLS_NO_CERT
+		}
+		return nil, nil
+	}
+
+	s := &cert_store{certFile: certFile, keyFile: keyFile}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{GetCertificate: s.get_certificate}
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, ERROR_TLS_VERSION
+		}
+		config.MinVersion = v
+	}
+	if len(ciphers) > 0 {
+		suites, err := cipher_suites(ciphers)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = suites
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ERROR_NO_CA_CERTS
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	_default_certs = s
+	return config, nil
+}
+
+// map cipher suite names(e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) to ids,
+// only suites considered secure by crypto/tls are allowed.
+// TLS 1.3 only suites are rejected, crypto/tls would silently ignore them.
+func cipher_suites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		for _, v := range suite.SupportedVersions {
+			if v <= tls.VersionTLS12 {
+				known[suite.Name] = suite.ID
+				break
+			}
+		}
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, ERROR_TLS_CIPHERSUITE
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// reload certificate from disk, the old one is kept on failure
+func reloadTLS() {
+	if _default_certs == nil {
+		return
+	}
+	if err := _default_certs.load(); err != nil {
+		log.Error("reload certificate failed:", err)
+		return
+	}
+	log.Info("certificate reloaded:", _default_certs.certFile)
+}